@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/html"
 )
@@ -16,14 +20,35 @@ type Flags struct {
 	input     string
 	cellCount int
 	outputDir string
+	wrap      bool
+	jobs      int
+	format    string
+	gzip      bool
+	since     time.Time
+	until     time.Time
+	products  []string
 }
 
 func parseFlags() (*Flags, error) {
 	var input string
 	var outputDir string
 	var cellCount int
+	var wrap bool
+	var jobs int
+	var format string
+	var gzipOut bool
+	var sinceStr string
+	var untilStr string
+	var productStr string
 	flag.IntVar(&cellCount, "count", 1000, "how many cells to split into each file")
 	flag.StringVar(&outputDir, "output", "", "output directory. if not specified, will use the directory of the input file")
+	flag.BoolVar(&wrap, "wrap", true, "wrap each partial with the original prologue/epilogue (doctype, head, wrapping tags) so it's valid standalone HTML; set -wrap=false to emit raw outer-cell fragments")
+	flag.IntVar(&jobs, "jobs", 1, "number of worker goroutines to post-process and write cells concurrently. each worker writes its own series of partials; if >1, output filenames are prefixed with the worker id")
+	flag.StringVar(&format, "format", "html", "output format: \"html\" to re-emit outer-cell fragments (see -wrap), or \"ndjson\" to parse each cell into a record and write one JSON object per line")
+	flag.BoolVar(&gzipOut, "gzip", false, "gzip-compress each partial as it's written, naming them *.gz. input ending in .gz is always transparently decompressed regardless of this flag")
+	flag.StringVar(&sinceStr, "since", "", "only keep cells timestamped on or after this date (RFC3339 or YYYY-MM-DD); cells with no parseable timestamp are dropped")
+	flag.StringVar(&untilStr, "until", "", "only keep cells timestamped on or before this date (RFC3339 or YYYY-MM-DD); cells with no parseable timestamp are dropped")
+	flag.StringVar(&productStr, "product", "", "comma-separated list of products to keep (e.g. \"Search,YouTube\"); cells from any other product are dropped")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] input\n", os.Args[0])
 		flag.PrintDefaults()
@@ -58,7 +83,80 @@ func parseFlags() (*Flags, error) {
 		return nil, fmt.Errorf("cell count must be greater than 0")
 	}
 
-	return &Flags{input: input, cellCount: cellCount, outputDir: outputDir}, nil
+	if jobs < 1 {
+		return nil, fmt.Errorf("jobs must be greater than 0")
+	}
+
+	if format != "html" && format != "ndjson" {
+		return nil, fmt.Errorf("format must be \"html\" or \"ndjson\", got %q", format)
+	}
+
+	var since, until time.Time
+	if sinceStr != "" {
+		since, err = parseFilterDate(sinceStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -since %q: %w", sinceStr, err)
+		}
+	}
+	if untilStr != "" {
+		until, err = parseFilterDate(untilStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -until %q: %w", untilStr, err)
+		}
+		// a bare date covers the whole of that day
+		if _, derr := time.Parse("2006-01-02", untilStr); derr == nil {
+			until = until.Add(24*time.Hour - time.Nanosecond)
+		}
+	}
+
+	var products []string
+	if productStr != "" {
+		for _, p := range strings.Split(productStr, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				products = append(products, p)
+			}
+		}
+	}
+
+	return &Flags{
+		input:     input,
+		cellCount: cellCount,
+		outputDir: outputDir,
+		wrap:      wrap,
+		jobs:      jobs,
+		format:    format,
+		gzip:      gzipOut,
+		since:     since,
+		until:     until,
+		products:  products,
+	}, nil
+}
+
+// filterDateLayouts are the formats accepted by -since/-until.
+var filterDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02",
+}
+
+func parseFilterDate(s string) (time.Time, error) {
+	var firstErr error
+	for _, layout := range filterDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return time.Time{}, firstErr
+}
+
+// partialExt is the file extension partials are written with, based on
+// -format.
+func partialExt(flags *Flags) string {
+	if flags.format == "ndjson" {
+		return "ndjson"
+	}
+	return "html"
 }
 
 // Function to check if a token has a specific class
@@ -71,29 +169,416 @@ func hasClass(token html.Token, class string) bool {
 	return false
 }
 
+// appendToFile reopens an already-closed partial and appends data to its end,
+// used to stamp the epilogue onto files that were rotated out before we
+// reached the real end of the document. If the partial is gzip-compressed,
+// raw bytes can't just be tacked onto the end of the existing member, so
+// instead we append data as a brand new gzip member -- concatenated gzip
+// members decompress back-to-back as a single stream, per the gzip spec.
+func appendToFile(name string, data []byte, useGzip bool) error {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if useGzip {
+		gz := gzip.NewWriter(f)
+		if _, werr := gz.Write(data); werr != nil {
+			gz.Close()
+			return werr
+		}
+		return gz.Close()
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// gzipFileReader wraps a *gzip.Reader and the underlying *os.File it reads
+// from, so closing it cleans up both.
+type gzipFileReader struct {
+	file *os.File
+	gz   *gzip.Reader
+}
+
+func (r *gzipFileReader) Read(p []byte) (int, error) {
+	return r.gz.Read(p)
+}
+
+func (r *gzipFileReader) Close() error {
+	gerr := r.gz.Close()
+	ferr := r.file.Close()
+	if gerr != nil {
+		return gerr
+	}
+	return ferr
+}
+
+// openInput opens path for reading, transparently wrapping it with a gzip
+// reader if the name ends in ".gz".
+func openInput(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(strings.ToLower(path), ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFileReader{file: f, gz: gz}, nil
+}
+
+// gzipFileWriter wraps a *gzip.Writer and the underlying *os.File it writes
+// to, so closing it flushes the gzip stream before closing the file.
+type gzipFileWriter struct {
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func (w *gzipFileWriter) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+func (w *gzipFileWriter) Close() error {
+	gerr := w.gz.Close()
+	ferr := w.file.Close()
+	if gerr != nil {
+		return gerr
+	}
+	return ferr
+}
+
+// createPartialWriter creates name for writing, transparently wrapping it
+// with a gzip writer when useGzip is set.
+func createPartialWriter(name string, useGzip bool) (io.WriteCloser, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if !useGzip {
+		return f, nil
+	}
+	return &gzipFileWriter{file: f, gz: gzip.NewWriter(f)}, nil
+}
+
+// partialSuffix returns the extra file extension appended to partials when
+// -gzip is set, so MyActivity-0001.html becomes MyActivity-0001.html.gz.
+func partialSuffix(flags *Flags) string {
+	if flags.gzip {
+		return ".gz"
+	}
+	return ""
+}
+
+// ActivityRecord is the structured form of a single outer-cell, produced in
+// -format=ndjson mode. Field names mirror the sections google_takeout_parser
+// itself looks for when it re-parses these HTML fragments.
+type ActivityRecord struct {
+	Product   string   `json:"product"`
+	Header    string   `json:"header"`
+	Title     string   `json:"title"`
+	TitleURL  string   `json:"title_url"`
+	Subtitles []string `json:"subtitles"`
+	Timestamp string   `json:"timestamp"`
+	Details   []string `json:"details"`
+	Locations []string `json:"locations"`
+}
+
+// timestampLayouts are the formats Takeout has been observed to render the
+// trailing timestamp line in, tried in order.
+var timestampLayouts = []string{
+	"Jan 2, 2006, 3:04:05 PM MST",
+	"Jan 2, 2006, 3:04:05 PM",
+	time.RFC3339,
+}
+
+func parseTimestamp(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC().Format(time.RFC3339), true
+		}
+	}
+	return "", false
+}
+
+// parseCell re-tokenizes a single captured outer-cell and pulls out the
+// fields of an ActivityRecord, keyed on the inner div's class names rather
+// than raw positions, since content-cell markup across products isn't
+// perfectly uniform.
+func parseCell(cell []byte) (*ActivityRecord, error) {
+	rec := &ActivityRecord{}
+	z := html.NewTokenizer(bytes.NewReader(cell))
+
+	var classStack []string
+	var text bytes.Buffer
+	inTitle := false
+	sawTitle := false
+	lastHref := ""
+
+	flushText := func() {
+		line := strings.TrimSpace(text.String())
+		text.Reset()
+		if line == "" {
+			return
+		}
+		top := ""
+		if len(classStack) > 0 {
+			top = classStack[len(classStack)-1]
+		}
+		switch {
+		case strings.Contains(top, "header-cell"):
+			rec.Header = line
+			if rec.Product == "" {
+				rec.Product = line
+			}
+		case inTitle:
+			rec.Title = line
+			if lastHref != "" {
+				rec.TitleURL = lastHref
+			}
+		case strings.Contains(top, "mdl-typography--caption"):
+			if strings.Contains(lastHref, "google.com/maps") {
+				rec.Locations = append(rec.Locations, line)
+			} else {
+				rec.Details = append(rec.Details, line)
+			}
+		case strings.Contains(top, "content-cell"):
+			if ts, ok := parseTimestamp(line); ok {
+				rec.Timestamp = ts
+			} else {
+				rec.Subtitles = append(rec.Subtitles, line)
+			}
+		}
+	}
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				flushText()
+				return rec, nil
+			}
+			return nil, z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			flushText()
+			if t.Data == "div" {
+				class := ""
+				for _, attr := range t.Attr {
+					if attr.Key == "class" {
+						class = attr.Val
+					}
+				}
+				classStack = append(classStack, class)
+			}
+			if t.Data == "p" && hasClass(t, "mdl-typography--title") {
+				inTitle = true
+				sawTitle = true
+			}
+			if t.Data == "a" {
+				for _, attr := range t.Attr {
+					if attr.Key == "href" {
+						lastHref = attr.Val
+					}
+				}
+			}
+			if t.Data == "br" {
+				flushText()
+			}
+		case html.EndTagToken:
+			t := z.Token()
+			flushText()
+			if t.Data == "div" && len(classStack) > 0 {
+				classStack = classStack[:len(classStack)-1]
+			}
+			if t.Data == "p" && sawTitle {
+				inTitle = false
+			}
+		case html.TextToken:
+			text.Write(z.Text())
+		}
+	}
+}
+
+// cellMeta is the subset of an ActivityRecord the manifest cares about,
+// pulled out alongside the formatted cell so building the manifest doesn't
+// require re-parsing every cell a second time.
+type cellMeta struct {
+	product   string
+	timestamp string
+}
+
+// formatCell turns a raw outer-cell into the bytes that should be written to
+// a partial, according to -format: the cell verbatim for "html", or one
+// marshaled ActivityRecord plus a trailing newline for "ndjson". It always
+// parses the cell so the caller gets cellMeta for the manifest, even in html
+// mode where the parsed record itself is discarded.
+func formatCell(flags *Flags, cell []byte) ([]byte, cellMeta, error) {
+	rec, err := parseCell(cell)
+	if err != nil {
+		return nil, cellMeta{}, err
+	}
+	meta := cellMeta{product: rec.Product, timestamp: rec.Timestamp}
+	if flags.format != "ndjson" {
+		return cell, meta, nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return nil, cellMeta{}, err
+	}
+	return append(line, '\n'), meta, nil
+}
+
+// cellMatchesFilter reports whether a cell's meta satisfies -since/-until/
+// -product. Cells with no parseable timestamp are dropped by a -since or
+// -until filter, since there's no way to confirm they're in range.
+func cellMatchesFilter(flags *Flags, meta cellMeta) bool {
+	if len(flags.products) > 0 {
+		matched := false
+		for _, p := range flags.products {
+			if strings.EqualFold(strings.TrimSpace(p), strings.TrimSpace(meta.product)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if flags.since.IsZero() && flags.until.IsZero() {
+		return true
+	}
+	if meta.timestamp == "" {
+		return false
+	}
+	ts, err := time.Parse(time.RFC3339, meta.timestamp)
+	if err != nil {
+		return false
+	}
+	if !flags.since.IsZero() && ts.Before(flags.since) {
+		return false
+	}
+	if !flags.until.IsZero() && ts.After(flags.until) {
+		return false
+	}
+	return true
+}
+
+// ManifestEntry describes one output partial: where it sits in the source
+// file, how many cells it holds, and which products/timestamps those cells
+// cover. Written out as index.json alongside the partials.
+type ManifestEntry struct {
+	Filename     string   `json:"filename"`
+	StartOffset  int64    `json:"start_offset"`
+	EndOffset    int64    `json:"end_offset"`
+	CellCount    int      `json:"cell_count"`
+	MinTimestamp string   `json:"min_timestamp,omitempty"`
+	MaxTimestamp string   `json:"max_timestamp,omitempty"`
+	Products     []string `json:"products"`
+}
+
+// recordCell folds one cell's meta/offsets into entry, lazily setting
+// StartOffset on the entry's first cell.
+func (entry *ManifestEntry) recordCell(meta cellMeta, startOffset, endOffset int64) {
+	if entry.CellCount == 0 {
+		entry.StartOffset = startOffset
+	}
+	entry.EndOffset = endOffset
+	entry.CellCount++
+	if meta.product != "" {
+		found := false
+		for _, p := range entry.Products {
+			if p == meta.product {
+				found = true
+				break
+			}
+		}
+		if !found {
+			entry.Products = append(entry.Products, meta.product)
+		}
+	}
+	if meta.timestamp != "" {
+		if entry.MinTimestamp == "" || meta.timestamp < entry.MinTimestamp {
+			entry.MinTimestamp = meta.timestamp
+		}
+		if entry.MaxTimestamp == "" || meta.timestamp > entry.MaxTimestamp {
+			entry.MaxTimestamp = meta.timestamp
+		}
+	}
+}
+
+// writeManifest writes the combined per-partial stats out as index.json in
+// outputDir, so tools like google_takeout_parser can seek directly to the
+// partial covering a date range or product without opening every file.
+func writeManifest(outputDir string, entries []*ManifestEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputDir, "index.json"), data, 0o644)
+}
+
 func readAndWriteToPartials(flags *Flags) error {
-	input, err := os.Open(flags.input)
+	if flags.jobs > 1 {
+		return readAndWriteToPartialsParallel(flags)
+	}
+	return readAndWriteToPartialsSequential(flags)
+}
+
+func readAndWriteToPartialsSequential(flags *Flags) error {
+	input, err := openInput(flags.input)
 	if err != nil {
 		return err
 	}
 	defer input.Close()
 
-	var outputFile *os.File
+	// prologue/epilogue wrapping only makes sense for the html format
+	wrap := flags.wrap && flags.format == "html"
+
+	var outputFile io.WriteCloser
 	var outputFileName string
 	currentFile := 1
 
+	// every file we've created, in order -- needed so the epilogue (only
+	// known once we hit EOF) can be appended to files that were already
+	// rotated out and closed
+	var writtenFiles []string
+
+	// bytes preceding the first outer-cell (doctype, head, opening wrapper
+	// tags). captured once, then replayed at the top of every partial.
+	var prologueBuf bytes.Buffer
+	var prologue []byte
+	sawFirstCell := false
+
+	// one manifest entry per output file, in the same order as writtenFiles
+	var manifest []*ManifestEntry
+	var currentEntry *ManifestEntry
+
 	openOutputFile := func() error {
 		// if we have an open file, close it and increment the current file
 		if outputFile != nil {
 			outputFile.Close()
 			currentFile++
 		}
-		outputFileName = filepath.Join(flags.outputDir, fmt.Sprintf("MyActivity-%04d.html", currentFile))
+		outputFileName = filepath.Join(flags.outputDir, fmt.Sprintf("MyActivity-%04d.%s%s", currentFile, partialExt(flags), partialSuffix(flags)))
 		var err error
-		outputFile, err = os.Create(outputFileName)
+		outputFile, err = createPartialWriter(outputFileName, flags.gzip)
 		if err != nil {
 			return err
 		}
+		writtenFiles = append(writtenFiles, outputFileName)
+		currentEntry = &ManifestEntry{Filename: filepath.Base(outputFileName)}
+		manifest = append(manifest, currentEntry)
+		if wrap && prologue != nil {
+			if _, werr := outputFile.Write(prologue); werr != nil {
+				return werr
+			}
+		}
 		return nil
 	}
 
@@ -101,7 +586,11 @@ func readAndWriteToPartials(flags *Flags) error {
 	if err != nil {
 		return err
 	}
-	defer outputFile.Close()
+	defer func() {
+		if outputFile != nil {
+			outputFile.Close()
+		}
+	}()
 
 	writtenCount := 0
 
@@ -132,8 +621,45 @@ func readAndWriteToPartials(flags *Flags) error {
 
 	blockContent = bytes.Buffer{}
 
+	// bytes seen since the last outer-cell closed. if another outer-cell
+	// starts, this was just an inter-cell gap and is discarded; if we hit
+	// EOF instead, it's the real epilogue (closing wrapper tags) and gets
+	// stamped onto every partial.
+	var epilogueBuf bytes.Buffer
+
+	// running count of source bytes consumed so far, used to record each
+	// partial's byte offset range in index.json
+	var offset int64
+	var cellStartOffset int64
+
+	finish := func() error {
+		if wrap {
+			epilogue := epilogueBuf.Bytes()
+			if len(epilogue) > 0 {
+				if outputFile != nil {
+					if _, werr := outputFile.Write(epilogue); werr != nil {
+						return werr
+					}
+				}
+				// stamp the same epilogue onto every partial that was
+				// already rotated out and closed
+				for _, name := range writtenFiles {
+					if name == outputFileName {
+						continue
+					}
+					if aerr := appendToFile(name, epilogue, flags.gzip); aerr != nil {
+						return aerr
+					}
+				}
+			}
+		}
+		return writeManifest(flags.outputDir, manifest)
+	}
+
 	for {
 		tt := z.Next()
+		tokenStart := offset
+		offset += int64(len(z.Raw()))
 		switch tt {
 		case html.ErrorToken:
 			if z.Err() == io.EOF {
@@ -141,19 +667,38 @@ func readAndWriteToPartials(flags *Flags) error {
 				if len(blockContent.String()) > 0 {
 					return fmt.Errorf("found EOF, but block content is not empty")
 				}
-				return nil
+				return finish()
 			} else {
 				return z.Err()
 			}
 		case html.DoctypeToken, html.CommentToken:
-			// skip these
+			if wrap && !sawFirstCell {
+				prologueBuf.Write(z.Raw())
+			}
 		case html.StartTagToken:
 			t := z.Token()
-			if t.Data == "div" && hasClass(t, "outer-cell") {
+			isOuterCell := t.Data == "div" && hasClass(t, "outer-cell")
+			if isOuterCell {
 				if inBlock {
 					return fmt.Errorf("found start tag for outer-cell, but we're already in a block")
 				}
 				inBlock = true
+				cellStartOffset = tokenStart
+				if wrap && !sawFirstCell {
+					sawFirstCell = true
+					prologue = prologueBuf.Bytes()
+					if outputFile != nil {
+						if _, werr := outputFile.Write(prologue); werr != nil {
+							return werr
+						}
+					}
+				}
+				// a new cell started, so whatever we'd accumulated since
+				// the last one closed was just an inter-cell gap
+				epilogueBuf.Reset()
+			}
+			if wrap && !sawFirstCell && !isOuterCell {
+				prologueBuf.Write(z.Raw())
 			}
 			// if were in the block, write any start tags to the block content
 			if inBlock {
@@ -161,6 +706,8 @@ func readAndWriteToPartials(flags *Flags) error {
 				if t.Data == "div" {
 					divDepth++
 				}
+			} else if wrap && sawFirstCell {
+				epilogueBuf.Write(z.Raw())
 			}
 
 		case html.EndTagToken:
@@ -175,14 +722,24 @@ func readAndWriteToPartials(flags *Flags) error {
 				blockContent.Write(z.Raw())
 				blockContent.Write([]byte("\n"))
 
-				// write to file
-				writeBuffer(blockContent.Bytes())
-				writtenCount++
+				// write to file, unless it's filtered out by -since/-until/-product
+				out, meta, ferr := formatCell(flags, blockContent.Bytes())
+				if ferr != nil {
+					return ferr
+				}
+				if cellMatchesFilter(flags, meta) {
+					if werr := writeBuffer(out); werr != nil {
+						return werr
+					}
+					writtenCount++
+					currentEntry.recordCell(meta, cellStartOffset, offset)
+				}
 
 				// reset the block content
 				blockContent.Reset()
 				inBlock = false
 				divDepth = 0
+				continue
 			}
 
 			// otherwise, if we're in a block, add the end tag to the block content
@@ -191,12 +748,231 @@ func readAndWriteToPartials(flags *Flags) error {
 					divDepth--
 				}
 				blockContent.Write(z.Raw())
+			} else if wrap {
+				if !sawFirstCell {
+					prologueBuf.Write(z.Raw())
+				} else {
+					epilogueBuf.Write(z.Raw())
+				}
 			}
 
 		case html.SelfClosingTagToken, html.TextToken:
 			// if we're in a block, add data to the buffer
 			if inBlock {
 				blockContent.Write(z.Raw())
+			} else if wrap {
+				if !sawFirstCell {
+					prologueBuf.Write(z.Raw())
+				} else {
+					epilogueBuf.Write(z.Raw())
+				}
+			}
+		default:
+			return fmt.Errorf("unknown token type: %v", tt)
+		}
+	}
+}
+
+// readAndWriteToPartialsParallel mirrors readAndWriteToPartialsSequential's
+// tokenizer loop, but instead of writing cells directly, dispatches each
+// completed outer-cell to one of flags.jobs worker goroutines round-robin
+// (by sequence number), so each worker's tokenize-to-write latency overlaps
+// with the others'. Cells are handed to workers in order, so each worker's
+// own output stays in document order even though workers run concurrently;
+// each worker just writes its own series of partials, there's no attempt to
+// interleave workers' output back into a single ordered stream.
+func readAndWriteToPartialsParallel(flags *Flags) error {
+	input, err := openInput(flags.input)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	// prologue/epilogue wrapping only makes sense for the html format
+	wrap := flags.wrap && flags.format == "html"
+
+	z := html.NewTokenizer(input)
+
+	divDepth := 0
+	inBlock := false
+	var blockContent bytes.Buffer
+
+	var prologueBuf bytes.Buffer
+	var epilogueBuf bytes.Buffer
+	sawFirstCell := false
+	seq := 0
+
+	// running count of source bytes consumed so far, used to record each
+	// cell's byte offset range in index.json
+	var offset int64
+	var cellStartOffset int64
+
+	workerChans := make([]chan cellPayload, flags.jobs)
+	workerFiles := make([][]string, flags.jobs)
+	workerManifests := make([][]*ManifestEntry, flags.jobs)
+	var wg sync.WaitGroup
+	var workerErrOnce sync.Once
+	var workerErr error
+	// done is closed the moment any worker returns an error, so the
+	// producer below stops blocking on a send to that worker's (now
+	// unconsumed) channel instead of deadlocking.
+	done := make(chan struct{})
+	var closeChansOnce sync.Once
+	closeChans := func() {
+		closeChansOnce.Do(func() {
+			for _, ch := range workerChans {
+				close(ch)
+			}
+		})
+	}
+
+	startWorkers := func(prologue []byte) {
+		for w := 0; w < flags.jobs; w++ {
+			workerChans[w] = make(chan cellPayload, 4)
+			wg.Add(1)
+			go func(workerID int) {
+				defer wg.Done()
+				if err := runSplitWorker(workerID, flags, prologue, workerChans[workerID], &workerFiles[workerID], &workerManifests[workerID]); err != nil {
+					workerErrOnce.Do(func() {
+						workerErr = err
+						close(done)
+					})
+				}
+			}(w)
+		}
+	}
+
+	for {
+		tt := z.Next()
+		tokenStart := offset
+		offset += int64(len(z.Raw()))
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return z.Err()
+			}
+			// done, defers should cleanup the rest
+			if len(blockContent.String()) > 0 {
+				return fmt.Errorf("found EOF, but block content is not empty")
+			}
+			if !sawFirstCell {
+				// no cells in the document at all, nothing to wait on, but
+				// still write an (empty) index.json so downstream tools that
+				// always open it after a split don't have to special-case this
+				return writeManifest(flags.outputDir, []*ManifestEntry{})
+			}
+			closeChans()
+			wg.Wait()
+			if workerErr != nil {
+				return workerErr
+			}
+			if wrap {
+				epilogue := epilogueBuf.Bytes()
+				if len(epilogue) > 0 {
+					for _, files := range workerFiles {
+						for _, name := range files {
+							if aerr := appendToFile(name, epilogue, flags.gzip); aerr != nil {
+								return aerr
+							}
+						}
+					}
+				}
+			}
+			var manifest []*ManifestEntry
+			for _, entries := range workerManifests {
+				manifest = append(manifest, entries...)
+			}
+			return writeManifest(flags.outputDir, manifest)
+		case html.DoctypeToken, html.CommentToken:
+			if wrap && !sawFirstCell {
+				prologueBuf.Write(z.Raw())
+			}
+		case html.StartTagToken:
+			t := z.Token()
+			isOuterCell := t.Data == "div" && hasClass(t, "outer-cell")
+			if isOuterCell {
+				if inBlock {
+					return fmt.Errorf("found start tag for outer-cell, but we're already in a block")
+				}
+				inBlock = true
+				cellStartOffset = tokenStart
+				if !sawFirstCell {
+					sawFirstCell = true
+					var prologue []byte
+					if wrap {
+						prologue = prologueBuf.Bytes()
+					}
+					startWorkers(prologue)
+				}
+				// a new cell started, so whatever we'd accumulated since
+				// the last one closed was just an inter-cell gap
+				epilogueBuf.Reset()
+			}
+			if wrap && !sawFirstCell && !isOuterCell {
+				prologueBuf.Write(z.Raw())
+			}
+			if inBlock {
+				blockContent.Write(z.Raw())
+				if t.Data == "div" {
+					divDepth++
+				}
+			} else if wrap && sawFirstCell {
+				epilogueBuf.Write(z.Raw())
+			}
+
+		case html.EndTagToken:
+			t := z.Token()
+			if inBlock && divDepth == 1 {
+				blockContent.Write(z.Raw())
+				blockContent.Write([]byte("\n"))
+
+				// hand the raw cell off to the next worker in round-robin
+				// order, copying out of blockContent since it's reused. The
+				// worker does the parsing/formatting and filtering, so that
+				// CPU work overlaps with the other workers' I/O instead of
+				// serializing on this goroutine.
+				raw := append([]byte(nil), blockContent.Bytes()...)
+				select {
+				case workerChans[seq%flags.jobs] <- cellPayload{
+					raw:         raw,
+					startOffset: cellStartOffset,
+					endOffset:   offset,
+				}:
+					seq++
+				case <-done:
+					closeChans()
+					wg.Wait()
+					return workerErr
+				}
+
+				blockContent.Reset()
+				inBlock = false
+				divDepth = 0
+				continue
+			}
+
+			if inBlock {
+				if t.Data == "div" {
+					divDepth--
+				}
+				blockContent.Write(z.Raw())
+			} else if wrap {
+				if !sawFirstCell {
+					prologueBuf.Write(z.Raw())
+				} else {
+					epilogueBuf.Write(z.Raw())
+				}
+			}
+
+		case html.SelfClosingTagToken, html.TextToken:
+			if inBlock {
+				blockContent.Write(z.Raw())
+			} else if wrap {
+				if !sawFirstCell {
+					prologueBuf.Write(z.Raw())
+				} else {
+					epilogueBuf.Write(z.Raw())
+				}
 			}
 		default:
 			return fmt.Errorf("unknown token type: %v", tt)
@@ -204,6 +980,84 @@ func readAndWriteToPartials(flags *Flags) error {
 	}
 }
 
+// cellPayload is what the tokenizer goroutine hands each worker: the
+// raw cell bytes plus its source offsets; the worker does the actual
+// parsing/formatting, so that CPU work (the second HTML-tokenize pass,
+// ndjson's JSON marshal) runs on the worker goroutines instead of being
+// serialized on the producer.
+type cellPayload struct {
+	raw         []byte
+	startOffset int64
+	endOffset   int64
+}
+
+// runSplitWorker consumes cells handed to it in order, formats each one
+// (parsing it and applying -since/-until/-product), and writes the ones
+// that pass the filter to its own series of MyActivity-w<id>-%04d.<ext>
+// partials (.html or .ndjson per -format, plus .gz with -gzip), rotating every flags.cellCount written cells. Filenames it
+// creates are appended to *files, and a ManifestEntry per partial is
+// appended to *manifest, so the caller can stamp the epilogue and write
+// index.json once the real end of the document is known.
+func runSplitWorker(workerID int, flags *Flags, prologue []byte, cells <-chan cellPayload, files *[]string, manifest *[]*ManifestEntry) error {
+	var outputFile io.WriteCloser
+	fileIndex := 1
+	writtenCount := 0
+	var currentEntry *ManifestEntry
+
+	openOutputFile := func() error {
+		if outputFile != nil {
+			outputFile.Close()
+			fileIndex++
+		}
+		name := filepath.Join(flags.outputDir, fmt.Sprintf("MyActivity-w%02d-%04d.%s%s", workerID, fileIndex, partialExt(flags), partialSuffix(flags)))
+		var err error
+		outputFile, err = createPartialWriter(name, flags.gzip)
+		if err != nil {
+			return err
+		}
+		*files = append(*files, name)
+		currentEntry = &ManifestEntry{Filename: filepath.Base(name)}
+		*manifest = append(*manifest, currentEntry)
+		if prologue != nil {
+			if _, werr := outputFile.Write(prologue); werr != nil {
+				return werr
+			}
+		}
+		return nil
+	}
+
+	if err := openOutputFile(); err != nil {
+		return err
+	}
+	defer func() {
+		if outputFile != nil {
+			outputFile.Close()
+		}
+	}()
+
+	for cell := range cells {
+		data, meta, ferr := formatCell(flags, cell.raw)
+		if ferr != nil {
+			return ferr
+		}
+		if !cellMatchesFilter(flags, meta) {
+			continue
+		}
+		if writtenCount >= flags.cellCount {
+			if err := openOutputFile(); err != nil {
+				return err
+			}
+			writtenCount = 0
+		}
+		if _, err := outputFile.Write(data); err != nil {
+			return err
+		}
+		writtenCount++
+		currentEntry.recordCell(meta, cell.startOffset, cell.endOffset)
+	}
+	return nil
+}
+
 func splitHtmlActivity() error {
 	flags, err := parseFlags()
 	if err != nil {
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fixtureHTML = `<!DOCTYPE html>
+<html><head><title>My Activity</title><style>body{color:red}</style></head>
+<body>
+<div class="header-cell mdl-typography--title">My Activity</div>
+<div class="outer-cell mdl-cell mdl-cell--12-col">
+  <div class="content-cell mdl-cell mdl-cell--6-col mdl-typography--body-1">
+    <div class="header-cell mdl-typography--title">Search</div>
+    <p class="mdl-typography--title"><a href="http://example.com/search?q=foo">Searched for foo</a></p>
+    <div class="content-cell mdl-cell mdl-cell--6-col mdl-typography--body-1">Jan 2, 2023, 3:04:05 PM UTC</div>
+  </div>
+</div>
+<div class="outer-cell mdl-cell mdl-cell--12-col">
+  <div class="content-cell mdl-cell mdl-cell--6-col mdl-typography--body-1">
+    <div class="header-cell mdl-typography--title">YouTube</div>
+    <p class="mdl-typography--title"><a href="http://youtube.com/watch?v=1">Watched a video</a></p>
+    <div class="content-cell mdl-cell mdl-cell--6-col mdl-typography--body-1">Mar 5, 2024, 1:00:00 PM UTC</div>
+  </div>
+</div>
+</body></html>
+`
+
+// chunk0-1: every partial produced with -wrap should be self-contained,
+// valid-looking HTML -- the original doctype/head/wrapper tags preceding the
+// first cell, properly closed, plus the closing tags that followed the last
+// cell.
+func TestReadAndWriteToPartialsSequentialWrapRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "MyActivity.html")
+	if err := os.WriteFile(input, []byte(fixtureHTML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := &Flags{input: input, cellCount: 1000, outputDir: dir, wrap: true, jobs: 1, format: "html"}
+	if err := readAndWriteToPartialsSequential(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.ReadFile(filepath.Join(dir, "MyActivity-0001.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(out)
+	for _, want := range []string{"<!DOCTYPE html>", "<title>My Activity</title>", "</style>", "</head>", "</body></html>"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("partial missing %q, got:\n%s", want, got)
+		}
+	}
+}
+
+// chunk0-2: if a worker goroutine errors out partway through, the producer
+// must give up and return that error instead of blocking forever trying to
+// send the next cell to the now-unconsumed worker channel.
+func TestReadAndWriteToPartialsParallelWorkerErrorDoesNotDeadlock(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "MyActivity.html")
+	if err := os.WriteFile(input, []byte(fixtureHTML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// worker 0's first output file is pre-occupied by a directory, so
+	// os.Create inside runSplitWorker fails as soon as the worker starts,
+	// before any cell reaches it.
+	if err := os.MkdirAll(filepath.Join(dir, "MyActivity-w00-0001.html"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := &Flags{input: input, cellCount: 1, outputDir: dir, wrap: true, jobs: 2, format: "html"}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- readAndWriteToPartialsParallel(flags)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error from the colliding output path, got nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("readAndWriteToPartialsParallel deadlocked instead of returning the worker's error")
+	}
+}
+
+// chunk0-3: parseCell should extract fields out of realistic, multi-class
+// Takeout markup, not just a contrived single-class fixture.
+func TestParseCellExtractsFields(t *testing.T) {
+	const cell = `<div class="outer-cell mdl-cell mdl-cell--12-col">
+  <div class="content-cell mdl-cell mdl-cell--6-col mdl-typography--body-1">
+    <div class="header-cell mdl-typography--title">Search</div>
+    <p class="mdl-typography--title"><a href="http://example.com/search?q=foo">Searched for foo</a></p>
+    <div class="content-cell mdl-cell mdl-cell--6-col mdl-typography--body-1">Jan 2, 2023, 3:04:05 PM UTC</div>
+  </div>
+</div>`
+
+	rec, err := parseCell([]byte(cell))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Product != "Search" {
+		t.Errorf("Product = %q, want %q", rec.Product, "Search")
+	}
+	if rec.Title != "Searched for foo" {
+		t.Errorf("Title = %q, want %q", rec.Title, "Searched for foo")
+	}
+	if rec.TitleURL != "http://example.com/search?q=foo" {
+		t.Errorf("TitleURL = %q, want %q", rec.TitleURL, "http://example.com/search?q=foo")
+	}
+	if rec.Timestamp != "2023-01-02T15:04:05Z" {
+		t.Errorf("Timestamp = %q, want %q", rec.Timestamp, "2023-01-02T15:04:05Z")
+	}
+}
+
+// chunk0-6: cellMatchesFilter's -since/-until bounds are inclusive, and
+// -product matching is case-insensitive.
+func TestCellMatchesFilter(t *testing.T) {
+	since, _ := parseFilterDate("2023-01-01")
+	until, _ := parseFilterDate("2023-12-31")
+
+	cases := []struct {
+		name string
+		meta cellMeta
+		want bool
+	}{
+		{"exact since boundary", cellMeta{product: "Search", timestamp: "2023-01-01T00:00:00Z"}, true},
+		{"exact until boundary", cellMeta{product: "Search", timestamp: "2023-12-31T00:00:00Z"}, true},
+		{"before since", cellMeta{product: "Search", timestamp: "2022-12-31T23:59:59Z"}, false},
+		{"after until", cellMeta{product: "Search", timestamp: "2024-01-01T00:00:01Z"}, false},
+		{"wrong product", cellMeta{product: "YouTube", timestamp: "2023-06-01T00:00:00Z"}, false},
+		{"case-insensitive product match", cellMeta{product: "search", timestamp: "2023-06-01T00:00:00Z"}, true},
+		{"no timestamp dropped by date filter", cellMeta{product: "Search", timestamp: ""}, false},
+	}
+
+	flags := &Flags{since: since, until: until, products: []string{"Search"}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cellMatchesFilter(flags, tc.meta); got != tc.want {
+				t.Errorf("cellMatchesFilter(%+v) = %v, want %v", tc.meta, got, tc.want)
+			}
+		})
+	}
+}